@@ -2,30 +2,157 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/igorwwwwwwwwwwwwwwwwwwww/igor-check-certs/pin"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
 )
 
 // from man sysexits
 
 // ExUsage - The command was used incorrectly, e.g., with the
-//           wrong number of arguments, a bad flag, a bad syntax
-//           in a parameter, or whatever.
+//
+//	wrong number of arguments, a bad flag, a bad syntax
+//	in a parameter, or whatever.
 const ExUsage = 64
 
 var hostsFile = flag.String("hosts", "", "path of file containing hostnames to check")
 var days = flag.Int("days", 30, "number of days to look into the future")
 var concurrency = flag.Int("concurrency", 8, "concurrent checks")
+var pinFile = flag.String("pin-file", "", "path of file storing pinned certificate fingerprints (TOFU)")
 
+// pinUpdate accepts and (re-)pins whatever certificate a host currently
+// presents. In -serve mode, honoring this on every periodic scan would
+// defeat TOFU pinning for the life of the daemon, so the exporter only
+// applies it to its first scan (see exporter.scan); a one-shot run applies
+// it for the single run, as expected.
+var pinUpdate = flag.Bool("pin-update", false, "accept and pin whatever certificate a host currently presents (applied once in -serve mode)")
+var format = flag.String("format", "text", "output format: text, json, ndjson")
+var timeout = flag.Duration("timeout", 10*time.Second, "dial and handshake timeout per host")
+var caBundle = flag.String("ca-bundle", "", "path to a PEM file of CA certificates to verify against, in place of the system roots")
+var insecure = flag.Bool("insecure", false, "skip certificate verification, but still parse and report on the presented chain")
+var sni = flag.String("sni", "", "override the ServerName (SNI) presented during the TLS handshake for every host")
+var serve = flag.String("serve", "", "listen address (e.g. :9219) to run as a long-running Prometheus exporter instead of a one-shot check")
+var interval = flag.Duration("interval", 5*time.Minute, "how often to re-scan hosts in -serve mode")
+var checkRevocation = flag.Bool("check-revocation", false, "check each leaf certificate's OCSP/CRL revocation status")
+var failOnUnknown = flag.Bool("fail-on-unknown", false, "treat an indeterminate revocation status as a failure")
+
+// result carries everything learned about a host's certificate, whether or
+// not the check ultimately passed, so that json/ndjson output has one
+// record per host regardless of pass/fail.
 type result struct {
-	Hostname string
-	Err      error
+	Hostname      string     `json:"hostname"`
+	FQDN          string     `json:"fqdn"`
+	Port          string     `json:"port"`
+	Protocol      string     `json:"protocol"`
+	SNI           string     `json:"sni,omitempty"`
+	TLSVersion    string     `json:"tls_version,omitempty"`
+	Issuer        string     `json:"issuer,omitempty"`
+	Serial        string     `json:"serial,omitempty"`
+	DNSNames      []string   `json:"dns_names,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	DaysRemaining int        `json:"days_remaining"`
+	ChainLength   int        `json:"chain_length,omitempty"`
+	CommonName    string     `json:"common_name,omitempty"`
+	ProbeSeconds  float64    `json:"probe_seconds,omitempty"`
+	OCSPStatus    string     `json:"ocsp_status,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	NextUpdate    *time.Time `json:"next_update,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	Err           error      `json:"-"`
+}
+
+// timePtr returns nil for a zero time.Time and a pointer to t otherwise, so
+// that result's *time.Time fields round-trip through json's omitempty
+// instead of always encoding as "0001-01-01T00:00:00Z".
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// protocol identifies how a connection should be established and, for
+// anything other than plain TLS, how STARTTLS should be negotiated before
+// the certificate is captured.
+type protocol string
+
+const (
+	protoHTTPS protocol = "https"
+	protoSMTP  protocol = "smtp"
+	protoIMAP  protocol = "imap"
+	protoPOP3  protocol = "pop3"
+	protoFTP   protocol = "ftp"
+	protoLDAP  protocol = "ldap"
+)
+
+// defaultPorts gives the well-known port for each supported protocol, used
+// when a host entry doesn't specify one explicitly.
+var defaultPorts = map[protocol]string{
+	protoHTTPS: "443",
+	protoSMTP:  "25",
+	protoIMAP:  "143",
+	protoPOP3:  "110",
+	protoFTP:   "21",
+	protoLDAP:  "389",
+}
+
+// target is a parsed host entry: which protocol to speak, and where to dial.
+type target struct {
+	Protocol protocol
+	Host     string
+	Port     string
+}
+
+// parseTarget accepts either a bare "host[:port]" (defaulting to 443/https)
+// or a URL-style "scheme://host[:port]" entry, e.g. "smtp://mail.example.com:25".
+func parseTarget(raw string) (target, error) {
+	if idx := strings.Index(raw, "://"); idx >= 0 {
+		scheme := protocol(strings.ToLower(raw[:idx]))
+		if _, ok := defaultPorts[scheme]; !ok {
+			return target{}, errors.Errorf("unsupported protocol %q", scheme)
+		}
+
+		host, port, err := splitHostPort(raw[idx+3:], defaultPorts[scheme])
+		if err != nil {
+			return target{}, err
+		}
+		return target{Protocol: scheme, Host: host, Port: port}, nil
+	}
+
+	host, port, err := splitHostPort(raw, defaultPorts[protoHTTPS])
+	if err != nil {
+		return target{}, err
+	}
+	return target{Protocol: protoHTTPS, Host: host, Port: port}, nil
+}
+
+func splitHostPort(hostport, defaultPort string) (string, string, error) {
+	if !strings.Contains(hostport, ":") {
+		return hostport, defaultPort, nil
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error parsing host:port")
+	}
+	return host, port, nil
 }
 
 func readHostsFile(hostsFile string) ([]string, error) {
@@ -51,80 +178,863 @@ func readHostsFile(hostsFile string) ([]string, error) {
 	return hosts, nil
 }
 
-func worker(queue chan string, results chan result) {
+// loadCABundle reads a PEM file of one or more CA certificates into a pool
+// suitable for tls.Config.RootCAs.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading ca bundle")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, errors.Errorf("no certificates found in ca bundle %s", path)
+	}
+
+	return pool, nil
+}
+
+func worker(queue chan string, results chan result, pinStore *pin.Store, rootCAs *x509.CertPool, allowPinUpdate bool) {
 	for host := range queue {
-		r, err := checkCertificate(host)
+		r, err := checkCertificate(host, pinStore, rootCAs, allowPinUpdate)
 		if err != nil {
 			r.Err = err
+			r.Error = err.Error()
 		}
 		results <- r
 	}
 }
 
-func checkCertificate(host string) (result, error) {
-	r := result{
-		Hostname: host,
+// runChecks fans hosts out across the worker pool and collects every
+// result. It's shared by the one-shot run and each scan of -serve mode.
+// allowPinUpdate gates whether a host with no matching pinned fingerprint is
+// re-pinned rather than failed; callers control when that's safe (see
+// exporter.scan).
+func runChecks(hosts []string, pinStore *pin.Store, rootCAs *x509.CertPool, allowPinUpdate bool) []result {
+	queue := make(chan string)
+	out := make(chan result)
+
+	for i := 0; i < *concurrency; i++ {
+		go worker(queue, out, pinStore, rootCAs, allowPinUpdate)
 	}
 
-	connectHost := host
-	if !strings.Contains(host, ":") {
-		connectHost = host + ":443"
+	go func() {
+		for _, host := range hosts {
+			queue <- host
+		}
+		close(queue)
+	}()
+
+	results := make([]result, 0, len(hosts))
+	for i := 0; i < len(hosts); i++ {
+		results = append(results, <-out)
 	}
+	return results
+}
+
+func checkCertificate(host string, pinStore *pin.Store, rootCAs *x509.CertPool, allowPinUpdate bool) (r result, err error) {
+	start := time.Now()
+	defer func() { r.ProbeSeconds = time.Since(start).Seconds() }()
 
-	conn, err := tls.Dial("tcp", connectHost, &tls.Config{})
+	t, err := parseTarget(host)
 	if err != nil {
-		return r, errors.Wrap(err, "tls dial")
+		r = result{Hostname: host}
+		return r, err
+	}
+
+	serverName := t.Host
+	if len(*sni) > 0 {
+		serverName = *sni
+	}
+
+	r = result{
+		Hostname: host,
+		Protocol: string(t.Protocol),
+		FQDN:     t.Host,
+		Port:     t.Port,
+		SNI:      serverName,
+	}
+
+	addr := net.JoinHostPort(t.Host, t.Port)
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: *insecure,
+	}
+
+	var conn *tls.Conn
+	if t.Protocol == protoHTTPS {
+		dialer := &net.Dialer{Timeout: *timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return r, errors.Wrap(err, "tls dial")
+		}
+	} else {
+		rawConn, err := net.DialTimeout("tcp", addr, *timeout)
+		if err != nil {
+			return r, errors.Wrap(err, "dial")
+		}
+		rawConn.SetDeadline(time.Now().Add(*timeout))
+
+		conn, err = startTLS(t.Protocol, rawConn, tlsConfig)
+		if err != nil {
+			rawConn.Close()
+			return r, errors.Wrap(err, "starttls")
+		}
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	r.TLSVersion = tlsVersionName(state.Version)
+
+	leaf := leafCertificate(state)
+	if leaf != nil {
+		r.Issuer = leaf.Issuer.String()
+		r.Serial = leaf.SerialNumber.String()
+		r.CommonName = leaf.Subject.CommonName
+		r.DNSNames = leaf.DNSNames
+		r.NotBefore = timePtr(leaf.NotBefore)
+		r.NotAfter = timePtr(leaf.NotAfter)
+		r.DaysRemaining = int(time.Until(leaf.NotAfter).Hours() / 24)
+	}
+
+	// Prefer the verified chain(s) built by the handshake so that
+	// intermediate cert expiries are caught too, not just the leaf's.
+	chains := state.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+	if len(chains) > 0 {
+		r.ChainLength = len(chains[0])
 	}
-	conn.Close()
 
 	certExpiry := time.Now().AddDate(0, 0, *days)
 
-	for i, cert := range conn.ConnectionState().PeerCertificates {
-		if certExpiry.After(cert.NotAfter) {
-			return r, errors.Errorf("cert[%d] %s expires at %v", i, cert.Subject.CommonName, cert.NotAfter)
+	for _, chain := range chains {
+		for i, cert := range chain {
+			if certExpiry.After(cert.NotAfter) {
+				return r, errors.Errorf("cert[%d] %s expires at %v", i, cert.Subject.CommonName, cert.NotAfter)
+			}
+		}
+	}
+
+	if *checkRevocation && leaf != nil {
+		var issuer *x509.Certificate
+		if len(chains) > 0 && len(chains[0]) > 1 {
+			issuer = chains[0][1]
+		}
+
+		status, revokedAt, nextUpdate, revErr := revocationStatus(leaf, issuer)
+		r.OCSPStatus = status
+		r.RevokedAt = timePtr(revokedAt)
+		r.NextUpdate = timePtr(nextUpdate)
+
+		if status == "revoked" {
+			return r, errors.Errorf("certificate revoked at %v", revokedAt)
+		}
+		if status == "unknown" && *failOnUnknown {
+			if revErr != nil {
+				return r, errors.Wrap(revErr, "revocation status unknown")
+			}
+			return r, errors.New("revocation status unknown")
+		}
+	}
+
+	if pinStore != nil && leaf != nil {
+		fingerprint := pin.Fingerprint(leaf)
+
+		if pinned, ok := pinStore.Find(addr); ok && !allowPinUpdate {
+			if !pinStore.Match(addr, fingerprint) {
+				return r, errors.Errorf("pinned cert mismatch: expected %s, got %s", pinned.Fingerprint, fingerprint)
+			}
+		} else {
+			pinStore.Add(addr, fingerprint, leaf.NotAfter)
 		}
 	}
 
 	return r, nil
 }
 
-func main() {
-	flag.Parse()
+// leafCertificate returns the server's own certificate, preferring the
+// verified chain's leaf but falling back to the first presented certificate
+// when verification was skipped (-insecure).
+func leafCertificate(state tls.ConnectionState) *x509.Certificate {
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		return state.VerifiedChains[0][0]
+	}
+	if len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[0]
+	}
+	return nil
+}
 
-	var hosts []string
-	hosts = append(hosts, flag.Args()...)
+// revocationStatus reports leaf's revocation status ("good", "revoked", or
+// "unknown"), checking OCSP first and falling back to CRLs when no OCSP
+// responder is configured, no issuer is known, or the OCSP query fails.
+func revocationStatus(leaf, issuer *x509.Certificate) (status string, revokedAt, nextUpdate time.Time, err error) {
+	if len(leaf.OCSPServer) > 0 && issuer != nil {
+		status, revokedAt, nextUpdate, err = ocspRevocationStatus(leaf, issuer)
+		if err == nil {
+			return status, revokedAt, nextUpdate, nil
+		}
+	}
+
+	if len(leaf.CRLDistributionPoints) > 0 {
+		return crlRevocationStatus(leaf, issuer)
+	}
+
+	return "unknown", time.Time{}, time.Time{}, err
+}
+
+// ocspRevocationStatus queries leaf.OCSPServer in turn, returning the first
+// responder that answers with a parseable, signature-verified response.
+func ocspRevocationStatus(leaf, issuer *x509.Certificate) (string, time.Time, time.Time, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, errors.Wrap(err, "error building ocsp request")
+	}
+
+	client := &http.Client{Timeout: *timeout}
+
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		ocspResp, err := queryOCSPResponder(client, server, req, leaf, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return ocspStatusName(ocspResp.Status), ocspResp.RevokedAt, ocspResp.NextUpdate, nil
+	}
+
+	return "", time.Time{}, time.Time{}, errors.Wrap(lastErr, "ocsp request failed")
+}
+
+func queryOCSPResponder(client *http.Client, server string, req []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	httpResp, err := client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(body, leaf, issuer)
+}
+
+// crlRevocationStatus fetches and checks leaf.CRLDistributionPoints in
+// turn, returning the first CRL that can be fetched, parsed, and whose
+// signature verifies against issuer. A CRL's distribution point is an
+// unauthenticated URL (often plain http://), so an unverified list is
+// worthless: anyone who can answer it could serve an empty list and have
+// every revoked cert come back "good".
+func crlRevocationStatus(leaf, issuer *x509.Certificate) (string, time.Time, time.Time, error) {
+	if issuer == nil {
+		return "unknown", time.Time{}, time.Time{}, errors.New("no issuer certificate available to verify crl signature")
+	}
+
+	client := &http.Client{Timeout: *timeout}
+
+	var lastErr error
+	for _, point := range leaf.CRLDistributionPoints {
+		httpResp, err := client.Get(point)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		body, err := io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			lastErr = errors.Wrap(err, "crl signature verification failed")
+			continue
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return "revoked", entry.RevocationTime, crl.NextUpdate, nil
+			}
+		}
+
+		return "good", time.Time{}, crl.NextUpdate, nil
+	}
+
+	return "unknown", time.Time{}, time.Time{}, lastErr
+}
+
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// tlsVersionName renders a tls.ConnectionState.Version as the human-readable
+// name used in its JSON/ndjson output.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// startTLS negotiates the protocol-specific STARTTLS/AUTH TLS handshake on
+// an already-connected plaintext conn, then upgrades it to TLS.
+func startTLS(proto protocol, conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	var err error
+	switch proto {
+	case protoSMTP:
+		err = smtpStartTLS(conn)
+	case protoIMAP:
+		err = imapStartTLS(conn)
+	case protoPOP3:
+		err = pop3StartTLS(conn)
+	case protoFTP:
+		err = ftpStartTLS(conn)
+	case protoLDAP:
+		err = ldapStartTLS(conn)
+	default:
+		return nil, errors.Errorf("no STARTTLS support for protocol %q", proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "tls handshake")
+	}
+	return tlsConn, nil
+}
+
+func smtpStartTLS(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if _, err := readSMTPResponse(r); err != nil {
+		return errors.Wrap(err, "reading smtp greeting")
+	}
+
+	if _, err := fmt.Fprintf(conn, "EHLO localhost\r\n"); err != nil {
+		return errors.Wrap(err, "sending ehlo")
+	}
+	if _, err := readSMTPResponse(r); err != nil {
+		return errors.Wrap(err, "reading ehlo response")
+	}
+
+	if _, err := fmt.Fprintf(conn, "STARTTLS\r\n"); err != nil {
+		return errors.Wrap(err, "sending starttls")
+	}
+	code, err := readSMTPResponse(r)
+	if err != nil {
+		return errors.Wrap(err, "reading starttls response")
+	}
+	if code != "220" {
+		return errors.Errorf("unexpected starttls response code %s", code)
+	}
+
+	return nil
+}
+
+// readSMTPResponse reads a (possibly multi-line) SMTP reply and returns its
+// three-digit status code.
+func readSMTPResponse(r *bufio.Reader) (string, error) {
+	var code string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if len(line) < 4 {
+			return "", errors.Errorf("malformed smtp response: %q", line)
+		}
+		code = line[:3]
+		if line[3] == ' ' {
+			break
+		}
+	}
+	return code, nil
+}
+
+func imapStartTLS(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if _, err := r.ReadString('\n'); err != nil {
+		return errors.Wrap(err, "reading imap greeting")
+	}
+
+	if _, err := fmt.Fprintf(conn, "a1 STARTTLS\r\n"); err != nil {
+		return errors.Wrap(err, "sending starttls")
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "reading starttls response")
+		}
+		if strings.HasPrefix(line, "a1 OK") {
+			return nil
+		}
+		if strings.HasPrefix(line, "a1 ") {
+			return errors.Errorf("starttls rejected: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+func pop3StartTLS(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if _, err := r.ReadString('\n'); err != nil {
+		return errors.Wrap(err, "reading pop3 greeting")
+	}
+
+	if _, err := fmt.Fprintf(conn, "STLS\r\n"); err != nil {
+		return errors.Wrap(err, "sending stls")
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "reading stls response")
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return errors.Errorf("stls rejected: %s", strings.TrimSpace(line))
+	}
+
+	return nil
+}
+
+func ftpStartTLS(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	if _, err := readFTPResponse(r); err != nil {
+		return errors.Wrap(err, "reading ftp greeting")
+	}
+
+	if _, err := fmt.Fprintf(conn, "AUTH TLS\r\n"); err != nil {
+		return errors.Wrap(err, "sending auth tls")
+	}
+
+	code, err := readFTPResponse(r)
+	if err != nil {
+		return errors.Wrap(err, "reading auth tls response")
+	}
+	if code != "234" {
+		return errors.Errorf("unexpected auth tls response code %s", code)
+	}
+
+	return nil
+}
+
+func readFTPResponse(r *bufio.Reader) (string, error) {
+	var code string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if len(line) < 4 {
+			return "", errors.Errorf("malformed ftp response: %q", line)
+		}
+		code = line[:3]
+		if line[3] == ' ' {
+			break
+		}
+	}
+	return code, nil
+}
+
+// ldapStartTLS issues the StartTLS extended operation described in RFC 4511
+// §4.14 and waits for a success result before the caller upgrades to TLS.
+func ldapStartTLS(conn net.Conn) error {
+	const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	if _, err := conn.Write(ldapExtendedRequest(1, ldapStartTLSOID)); err != nil {
+		return errors.Wrap(err, "sending ldap starttls request")
+	}
+
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return errors.Wrap(err, "reading ldap starttls response")
+	}
+
+	resultCode, err := ldapExtendedResponseCode(resp[:n])
+	if err != nil {
+		return errors.Wrap(err, "parsing ldap starttls response")
+	}
+	if resultCode != 0 {
+		return errors.Errorf("ldap starttls rejected with result code %d", resultCode)
+	}
+
+	return nil
+}
+
+// berEncodeLength encodes n as a BER length field: a single byte for n < 128
+// (short form), or a 0x80|len(bytes) lead byte followed by the big-endian
+// bytes of n otherwise (long form, ITU-T X.690 §8.1.3).
+func berEncodeLength(n int) []byte {
+	if n < 128 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if v := byte(n >> shift); v != 0 || len(b) > 0 {
+			b = append(b, v)
+		}
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// berTLV wraps value in a BER tag-length-value encoding, using short- or
+// long-form length as needed.
+func berTLV(tag byte, value []byte) []byte {
+	return append(append([]byte{tag}, berEncodeLength(len(value))...), value...)
+}
+
+// berLength reads the BER length field starting at data[i]: either a single
+// length byte (short form, values under 128) or a 0x80|n lead byte followed
+// by n big-endian length bytes (long form). It returns the decoded length
+// and the offset of the first content byte.
+func berLength(data []byte, i int) (length, next int, err error) {
+	if i >= len(data) {
+		return 0, 0, errors.New("truncated ber length")
+	}
+
+	b := data[i]
+	if b&0x80 == 0 {
+		return int(b), i + 1, nil
+	}
+
+	n := int(b &^ 0x80)
+	if n == 0 || i+1+n > len(data) {
+		return 0, 0, errors.New("truncated ber length")
+	}
+	for _, c := range data[i+1 : i+1+n] {
+		length = length<<8 | int(c)
+	}
+	return length, i + 1 + n, nil
+}
+
+// ldapExtendedRequest builds a minimal BER-encoded LDAPv3 ExtendedRequest
+// carrying only a requestName OID, which is all StartTLS requires.
+func ldapExtendedRequest(messageID int, oid string) []byte {
+	requestName := berTLV(0x80, []byte(oid))
+	extendedReq := berTLV(0x77, requestName)
+	msgID := berTLV(0x02, []byte{byte(messageID)})
+	return berTLV(0x30, append(append([]byte{}, msgID...), extendedReq...))
+}
+
+// ldapExtendedResponseCode extracts the resultCode from an ExtendedResponse,
+// skipping over the messageID and response tag/length headers. Each length
+// field is decoded with berLength rather than assumed to be a single
+// short-form byte, so a response long enough to need long-form lengths (a
+// verbose diagnosticMessage, say) is still parsed correctly.
+func ldapExtendedResponseCode(data []byte) (int, error) {
+	if len(data) < 2 || data[0] != 0x30 {
+		return 0, errors.New("malformed ldap message")
+	}
+
+	_, i, err := berLength(data, 1) // outer SEQUENCE length
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing ldap message length")
+	}
+
+	if i >= len(data) || data[i] != 0x02 {
+		return 0, errors.New("malformed ldap message id")
+	}
+	idLen, i, err := berLength(data, i+1)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing ldap message id length")
+	}
+	i += idLen
+
+	if i >= len(data) {
+		return 0, errors.New("truncated ldap response")
+	}
+	i++ // skip extendedResponse tag
+	_, i, err = berLength(data, i)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing ldap response length")
+	}
+
+	if i >= len(data) || data[i] != 0x0a {
+		return 0, errors.New("malformed ldap result code")
+	}
+	resultLen, i, err := berLength(data, i+1)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing ldap result code length")
+	}
+	if resultLen < 1 || i+resultLen > len(data) {
+		return 0, errors.New("truncated ldap result code")
+	}
+	// resultCode is a small ENUMERATED value; a single byte covers every
+	// defined LDAP result code.
+	return int(data[i]), nil
+}
+
+// exporter turns the one-shot worker pool into a long-running Prometheus
+// exporter: hosts are re-scanned on a timer, the hosts file is re-read on
+// SIGHUP (taking effect at the next scan), and the latest
+// result per host is served from a mutex-protected cache.
+type exporter struct {
+	extraHosts []string
+	pinStore   *pin.Store
+	rootCAs    *x509.CertPool
+
+	mu        sync.Mutex
+	hosts     []string
+	results   map[string]result
+	scanCount int
+}
+
+func newExporter(extraHosts []string, pinStore *pin.Store, rootCAs *x509.CertPool) *exporter {
+	return &exporter{
+		extraHosts: extraHosts,
+		pinStore:   pinStore,
+		rootCAs:    rootCAs,
+		results:    make(map[string]result),
+	}
+}
+
+// reload re-reads the hosts file (if any), combining it with the hosts
+// passed on the command line.
+func (e *exporter) reload() error {
+	hosts := append([]string{}, e.extraHosts...)
 
 	if len(*hostsFile) > 0 {
 		fileHosts, err := readHostsFile(*hostsFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(ExUsage)
+			return err
 		}
 		hosts = append(hosts, fileHosts...)
 	}
 
-	queue := make(chan string)
-	results := make(chan result)
+	e.mu.Lock()
+	e.hosts = hosts
+	e.mu.Unlock()
 
-	// start workers
-	for i := 0; i < *concurrency; i++ {
-		go worker(queue, results)
+	return nil
+}
+
+// scan re-checks every known host and refreshes the result cache. Pinned
+// entries whose stored expiry has passed are purged first, so a host that
+// legitimately rotated its certificate gets silently re-pinned on this scan
+// instead of reporting a mismatch forever. -pin-update is only honored on
+// the exporter's first scan, not every periodic rescan, so leaving it set
+// doesn't defeat TOFU pinning for the life of the daemon.
+func (e *exporter) scan() {
+	if e.pinStore != nil {
+		e.pinStore.Purge()
 	}
 
-	// enqueue work
+	e.mu.Lock()
+	hosts := append([]string{}, e.hosts...)
+	allowPinUpdate := *pinUpdate && e.scanCount == 0
+	e.scanCount++
+	e.mu.Unlock()
+
+	results := runChecks(hosts, e.pinStore, e.rootCAs, allowPinUpdate)
+
+	// Rebuild from scratch rather than merge, so a host dropped from the
+	// hosts file on reload stops being exposed instead of serving stale
+	// metrics forever.
+	fresh := make(map[string]result, len(results))
+	for _, r := range results {
+		fresh[r.Hostname] = r
+	}
+
+	e.mu.Lock()
+	e.results = fresh
+	e.mu.Unlock()
+
+	if e.pinStore != nil {
+		if err := e.pinStore.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: saving pin file: %v\n", err)
+		}
+	}
+}
+
+func (e *exporter) snapshot() []result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]result, 0, len(e.results))
+	for _, r := range e.results {
+		out = append(out, r)
+	}
+	return out
+}
+
+// metricsHandler renders the result cache as Prometheus text exposition
+// format.
+func (e *exporter) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, r := range e.snapshot() {
+		certLabels := fmt.Sprintf("host=%q,issuer=%q,serial=%q,cn=%q", r.Hostname, r.Issuer, r.Serial, r.CommonName)
+		hostLabel := fmt.Sprintf("host=%q", r.Hostname)
+
+		success := 1
+		if r.Err != nil {
+			success = 0
+		}
+		fmt.Fprintf(w, "ssl_probe_success{%s} %d\n", hostLabel, success)
+		fmt.Fprintf(w, "ssl_probe_duration_seconds{%s} %f\n", hostLabel, r.ProbeSeconds)
+
+		if r.NotAfter != nil {
+			fmt.Fprintf(w, "ssl_cert_not_after_seconds{%s} %d\n", certLabels, r.NotAfter.Unix())
+			fmt.Fprintf(w, "ssl_cert_days_remaining{%s} %d\n", certLabels, r.DaysRemaining)
+		}
+	}
+}
+
+// runServer starts the -serve exporter: an initial scan, a ticker that
+// rescans every -interval, a SIGHUP handler that re-reads the hosts file,
+// and an HTTP server exposing /metrics.
+func runServer(addr string, extraHosts []string, pinStore *pin.Store, rootCAs *x509.CertPool) {
+	e := newExporter(extraHosts, pinStore, rootCAs)
+	if err := e.reload(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(ExUsage)
+	}
+	e.scan()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 	go func() {
-		for _, host := range hosts {
-			queue <- host
+		for range sighup {
+			if err := e.reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "error: reloading hosts file: %v\n", err)
+			}
 		}
-		close(queue)
 	}()
 
+	go func() {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.scan()
+		}
+	}()
+
+	http.HandleFunc("/metrics", e.metricsHandler)
+	fmt.Fprintf(os.Stderr, "listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	switch *format {
+	case "text", "json", "ndjson":
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown -format %q\n", *format)
+		os.Exit(ExUsage)
+	}
+
+	var extraHosts []string
+	extraHosts = append(extraHosts, flag.Args()...)
+
+	var pinStore *pin.Store
+	if len(*pinFile) > 0 {
+		var err error
+		pinStore, err = pin.Load(*pinFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(ExUsage)
+		}
+		pinStore.Purge()
+	}
+
+	var rootCAs *x509.CertPool
+	if len(*caBundle) > 0 {
+		var err error
+		rootCAs, err = loadCABundle(*caBundle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(ExUsage)
+		}
+	}
+
+	if len(*serve) > 0 {
+		runServer(*serve, extraHosts, pinStore, rootCAs)
+		return
+	}
+
+	hosts := append([]string{}, extraHosts...)
+	if len(*hostsFile) > 0 {
+		fileHosts, err := readHostsFile(*hostsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(ExUsage)
+		}
+		hosts = append(hosts, fileHosts...)
+	}
+
 	// consume results
 	anyErrors := false
-	for i := 0; i < len(hosts); i++ {
-		r := <-results
+	var jsonResults []result
+	encoder := json.NewEncoder(os.Stdout)
+	for _, r := range runChecks(hosts, pinStore, rootCAs, *pinUpdate) {
 		if r.Err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s: %v\n", r.Hostname, r.Err)
+			anyErrors = true
+		}
+
+		switch *format {
+		case "text":
+			if r.Err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s: %v\n", r.Hostname, r.Err)
+			}
+		case "ndjson":
+			if err := encoder.Encode(r); err != nil {
+				fmt.Fprintf(os.Stderr, "error: encoding result: %v\n", err)
+				anyErrors = true
+			}
+		case "json":
+			jsonResults = append(jsonResults, r)
+		}
+	}
+
+	if *format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(jsonResults); err != nil {
+			fmt.Fprintf(os.Stderr, "error: encoding results: %v\n", err)
+			anyErrors = true
+		}
+	}
+
+	if pinStore != nil {
+		if err := pinStore.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: saving pin file: %v\n", err)
 			anyErrors = true
 		}
 	}
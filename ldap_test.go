@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLdapExtendedResponseCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCode int
+		wantErr  bool
+	}{
+		{
+			name: "success, short-form lengths throughout",
+			// SEQUENCE { messageID INTEGER 1, [APPLICATION 24] { resultCode ENUMERATED 0 } }
+			data:     []byte{0x30, 0x08, 0x02, 0x01, 0x01, 0x78, 0x03, 0x0a, 0x01, 0x00},
+			wantCode: 0,
+		},
+		{
+			name:     "nonzero result code, short-form lengths",
+			data:     []byte{0x30, 0x08, 0x02, 0x01, 0x01, 0x78, 0x03, 0x0a, 0x01, 0x31}, // 0x31 = 49 (invalidCredentials)
+			wantCode: 49,
+		},
+		{
+			name:    "truncated message",
+			data:    []byte{0x30, 0x08, 0x02, 0x01, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "not a sequence",
+			data:    []byte{0x04, 0x02, 0x00, 0x00},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := ldapExtendedResponseCode(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ldapExtendedResponseCode(%x) = nil error, want error", tt.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ldapExtendedResponseCode(%x) = %v, want no error", tt.data, err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestLdapExtendedResponseCodeLongForm builds an ExtendedResponse whose
+// diagnosticMessage is long enough to force every length in the message
+// (the extendedResponse wrapper and the outer SEQUENCE) into long-form BER
+// encoding, and checks the resultCode is still extracted correctly.
+func TestLdapExtendedResponseCodeLongForm(t *testing.T) {
+	resultCode := berTLV(0x0a, []byte{0x00})
+	diagnosticMessage := berTLV(0x04, bytes.Repeat([]byte("x"), 200))
+	extendedResponse := berTLV(0x78, append(append([]byte{}, resultCode...), diagnosticMessage...))
+	messageID := berTLV(0x02, []byte{0x01})
+	data := berTLV(0x30, append(append([]byte{}, messageID...), extendedResponse...))
+
+	if len(data) < 200 {
+		t.Fatalf("test message is only %d bytes, too short to exercise long-form lengths", len(data))
+	}
+
+	code, err := ldapExtendedResponseCode(data)
+	if err != nil {
+		t.Fatalf("ldapExtendedResponseCode() = %v, want no error", err)
+	}
+	if code != 0 {
+		t.Errorf("code = %d, want 0", code)
+	}
+}
+
+func TestLdapExtendedRequestRoundTrip(t *testing.T) {
+	const oid = "1.3.6.1.4.1.1466.20037"
+	req := ldapExtendedRequest(1, oid)
+
+	if !bytes.Contains(req, []byte(oid)) {
+		t.Fatalf("ldapExtendedRequest() = %x, does not contain OID %q", req, oid)
+	}
+	if req[0] != 0x30 {
+		t.Errorf("leading tag = %#x, want outer SEQUENCE tag 0x30", req[0])
+	}
+
+	length, next, err := berLength(req, 1)
+	if err != nil {
+		t.Fatalf("berLength() = %v", err)
+	}
+	if next+length != len(req) {
+		t.Errorf("encoded length %d from offset %d doesn't match actual message length %d", length, next, len(req))
+	}
+}
+
+func TestBerEncodeLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x80}},
+		{200, []byte{0x81, 0xc8}},
+		{256, []byte{0x82, 0x01, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got := berEncodeLength(tt.n)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("berEncodeLength(%d) = %x, want %x", tt.n, got, tt.want)
+			}
+
+			length, next, err := berLength(append(append([]byte{}, got...), make([]byte, tt.n)...), 0)
+			if err != nil {
+				t.Fatalf("berLength() = %v", err)
+			}
+			if length != tt.n {
+				t.Errorf("berLength() decoded %d, want %d", length, tt.n)
+			}
+			if next != len(got) {
+				t.Errorf("berLength() consumed %d bytes, want %d", next, len(got))
+			}
+		})
+	}
+}
+
+func TestBerLengthTruncated(t *testing.T) {
+	if _, _, err := berLength(nil, 0); err == nil {
+		t.Fatal("berLength(nil, 0) = nil error, want error")
+	}
+	if _, _, err := berLength([]byte{0x82, 0x01}, 0); err == nil {
+		t.Fatal("berLength() on a truncated long-form length = nil error, want error")
+	} else if !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("error = %v, want it to mention truncation", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Package pin implements a TOFU-style (trust-on-first-use) certificate
+// pinning store, modeled after the TofuDigest approach used by the
+// Bombadillo Gopher/Gemini client: on first successful check a host's leaf
+// certificate fingerprint and expiry are recorded, and later checks fail
+// any host that now presents a certificate that doesn't match.
+package pin
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a single pinned certificate: its SHA-256 fingerprint and the
+// NotAfter it was observed to carry.
+type Entry struct {
+	Fingerprint string
+	NotAfter    time.Time
+}
+
+// Store is an in-memory, file-backed set of pinned entries keyed by
+// lowercased "host:port". It is safe for concurrent use.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]Entry
+}
+
+// Load reads a pin store from path. A missing file is treated as an empty,
+// not-yet-populated store rather than an error, so a fresh -pin-file can be
+// pointed at a path that doesn't exist yet.
+func Load(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: make(map[string]Entry),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening pin file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, entry, err := parseLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing pin file %s", path)
+		}
+		s.entries[key] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading pin file")
+	}
+
+	return s, nil
+}
+
+// parseLine parses a single "key hash|notAfter-unix" line.
+func parseLine(line string) (string, Entry, error) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return "", Entry{}, errors.Errorf("malformed pin entry: %q", line)
+	}
+
+	key := fields[0]
+	parts := strings.SplitN(fields[1], "|", 2)
+	if len(parts) != 2 {
+		return "", Entry{}, errors.Errorf("malformed pin entry: %q", line)
+	}
+
+	notAfterUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", Entry{}, errors.Wrapf(err, "malformed pin entry: %q", line)
+	}
+
+	return key, Entry{
+		Fingerprint: parts[0],
+		NotAfter:    time.Unix(notAfterUnix, 0),
+	}, nil
+}
+
+// Save writes the store back out to its path, one "key hash|notAfter-unix"
+// line per entry.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Create(s.path)
+	if err != nil {
+		return errors.Wrap(err, "error creating pin file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for key, entry := range s.entries {
+		fmt.Fprintf(w, "%s %s|%d\n", key, entry.Fingerprint, entry.NotAfter.Unix())
+	}
+
+	return w.Flush()
+}
+
+// key normalizes a host:port for use as a map key.
+func key(hostport string) string {
+	return strings.ToLower(hostport)
+}
+
+// Find returns the pinned entry for hostport, if any.
+func (s *Store) Find(hostport string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key(hostport)]
+	return e, ok
+}
+
+// Match reports whether fingerprint matches the pinned entry for hostport.
+// A host with no pinned entry does not match.
+func (s *Store) Match(hostport, fingerprint string) bool {
+	e, ok := s.Find(hostport)
+	return ok && e.Fingerprint == fingerprint
+}
+
+// Add pins fingerprint/notAfter for hostport, replacing any existing entry.
+func (s *Store) Add(hostport, fingerprint string, notAfter time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key(hostport)] = Entry{
+		Fingerprint: fingerprint,
+		NotAfter:    notAfter,
+	}
+}
+
+// Purge drops entries whose pinned NotAfter has already passed, since a
+// host that rotated to a new cert after the old one expired needs to be
+// re-pinned rather than permanently flagged as a mismatch.
+func (s *Store) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.entries {
+		if now.After(e.NotAfter) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// Fingerprint returns the hex-encoded SHA-256 digest of a certificate's raw
+// DER bytes.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
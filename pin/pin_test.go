@@ -0,0 +1,98 @@
+package pin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantKey string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			line:    "example.com:443 abcd1234|1700000000",
+			wantKey: "example.com:443",
+		},
+		{
+			name:    "missing fingerprint and notAfter",
+			line:    "example.com:443",
+			wantErr: true,
+		},
+		{
+			name:    "missing notAfter separator",
+			line:    "example.com:443 abcd1234",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric notAfter",
+			line:    "example.com:443 abcd1234|soon",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, entry, err := parseLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseLine(%q) = nil error, want error", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine(%q) = %v, want no error", tt.line, err)
+			}
+			if key != tt.wantKey {
+				t.Errorf("key = %q, want %q", key, tt.wantKey)
+			}
+			if entry.Fingerprint != "abcd1234" {
+				t.Errorf("Fingerprint = %q, want %q", entry.Fingerprint, "abcd1234")
+			}
+			if !entry.NotAfter.Equal(time.Unix(1700000000, 0)) {
+				t.Errorf("NotAfter = %v, want %v", entry.NotAfter, time.Unix(1700000000, 0))
+			}
+		})
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/pins"
+
+	s := &Store{path: path, entries: make(map[string]Entry)}
+	s.Add("one.example.com:443", "fingerprint-one", time.Unix(1700000000, 0))
+	s.Add("two.example.com:636", "fingerprint-two", time.Unix(1800000000, 0))
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+
+	for addr, want := range s.entries {
+		got, ok := loaded.Find(addr)
+		if !ok {
+			t.Errorf("Find(%q) after round-trip: not found", addr)
+			continue
+		}
+		if got.Fingerprint != want.Fingerprint || !got.NotAfter.Equal(want.NotAfter) {
+			t.Errorf("Find(%q) = %+v, want %+v", addr, got, want)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	s, err := Load("/nonexistent/path/pins")
+	if err != nil {
+		t.Fatalf("Load() on missing file = %v, want no error", err)
+	}
+	if _, ok := s.Find("example.com:443"); ok {
+		t.Fatalf("Find() on freshly loaded missing file = found, want not found")
+	}
+}